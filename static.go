@@ -3,11 +3,24 @@
 package spa
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"html/template"
+	"io"
 	"io/fs"
 	"net/http"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Option is used to modify the behavior of StaticHandler.
@@ -17,6 +30,102 @@ type handler struct {
 	fs            http.FileSystem
 	fallback      string
 	indexRedirect bool
+	precompressed []string
+	basePath      string
+
+	templateData    func(r *http.Request) any
+	templateGlob    string
+	noTemplateCache bool
+	cspNonce        func(w http.ResponseWriter, r *http.Request, nonce string)
+
+	templatesMu sync.RWMutex
+	templates   map[string]*compiledTemplate
+
+	errorHandler func(w http.ResponseWriter, r *http.Request, err error, stage ErrorStage) bool
+
+	excludes       []*regexp.Regexp
+	excludeHandler http.Handler
+
+	cacheRules     []compiledCacheRule
+	defaultCaching bool
+}
+
+// CacheRule matches request paths and sets caching-related headers on the
+// response, for use with CacheControl.
+type CacheRule struct {
+	// Pattern matches the request path the same way Exclude does: a regular
+	// expression if it starts with "^", otherwise a glob where "*" matches
+	// any sequence of characters (including "/") and "?" matches exactly
+	// one.
+	Pattern string
+	// CacheControl is the value written to the Cache-Control header.
+	CacheControl string
+	// Expires, when non-zero, sets the Expires header to this long from
+	// the time of the request.
+	Expires time.Duration
+}
+
+type compiledCacheRule struct {
+	pattern *regexp.Regexp
+	rule    CacheRule
+}
+
+// hashedAssetPattern matches file names carrying a content hash, e.g.
+// "app.3f2a9c1d.js", as produced by most bundlers' production builds.
+var hashedAssetPattern = regexp.MustCompile(`\.[0-9a-f]{8,}\.[^./]+$`)
+
+// ErrorStage identifies at which point of request resolution an error
+// occurred, for use with ErrorHandler.
+type ErrorStage int
+
+const (
+	// StageLookup is the initial filesystem lookup of the requested path.
+	StageLookup ErrorStage = iota
+	// StageStat is stat'ing the looked-up file, including rejecting
+	// anything that isn't a regular file.
+	StageStat
+	// StageOpenFallback is opening and stat'ing the fallback file.
+	StageOpenFallback
+	// StageServe is an I/O error encountered while streaming a file body
+	// that has already started being written to the response.
+	StageServe
+)
+
+func (s ErrorStage) String() string {
+	switch s {
+	case StageLookup:
+		return "lookup"
+	case StageStat:
+		return "stat"
+	case StageOpenFallback:
+		return "open-fallback"
+	case StageServe:
+		return "serve"
+	default:
+		return "unknown"
+	}
+}
+
+type compiledTemplate struct {
+	tmpl *template.Template
+	src  []byte
+}
+
+// templateContext is the value passed to templates rendered through
+// TemplateFallback/TemplateGlob. Data holds whatever the user-supplied
+// function returned.
+type templateContext struct {
+	Nonce    string
+	BasePath string
+	Data     any
+}
+
+// precompressedExt maps a content-coding name (as used in Accept-Encoding)
+// to the file extension appended to the uncompressed asset name.
+var precompressedExt = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
 }
 
 // StaticHandler returns a http.Handler that serves HTTP requests with the
@@ -41,6 +150,15 @@ func StaticHandler(fs http.FileSystem, opts ...Option) http.Handler {
 		opt(h)
 	}
 
+	if h.templateData != nil {
+		ct, err := h.parseTemplate(h.fallback)
+		if err != nil {
+			panic(err)
+		}
+
+		h.templates = map[string]*compiledTemplate{h.fallback: ct}
+	}
+
 	return h
 }
 
@@ -62,51 +180,513 @@ func NoIndexRedirect() Option {
 	}
 }
 
+// PrecompressedEncodings enables serving precompressed variants of static
+// assets. For a request to "/app.js", the handler looks for a sibling file
+// named "/app.js"+ext next to it ("br" -> ".br", "gzip" -> ".gz", "zstd" ->
+// ".zst") and serves it instead of the original when the client's
+// Accept-Encoding header allows it.
+//
+// encodings is the server's preference order: among the encodings the client
+// accepts, the one listed first that also has a matching file on disk wins.
+// Unknown encoding names are ignored. When no listed encoding is accepted (or
+// none of the precompressed files exist), the uncompressed file is served.
+//
+//	StaticHandler(fs, PrecompressedEncodings([]string{"br", "gzip"}))
+func PrecompressedEncodings(encodings []string) Option {
+	return func(h *handler) {
+		h.precompressed = encodings
+	}
+}
+
+// TemplateFallback treats the fallback file as a Go html/template. It is
+// parsed once, when StaticHandler applies options, and the compiled template
+// is cached for the lifetime of the handler. StaticHandler panics if the
+// fallback file can't be opened or fails to parse, so a broken template is
+// caught at startup instead of surfacing as a 500 on the first request. On
+// every request, fn is called and its result is exposed to the template as
+// {{.Data}}.
+//
+// This is useful to inject per-deployment values into the SPA shell, such as
+// a <base href>, a JSON blob of runtime configuration, or (combined with
+// TemplateCSPNonce) a CSP nonce.
+//
+//	StaticHandler(fs, TemplateFallback(func(r *http.Request) any {
+//		return map[string]string{"Env": "production"}
+//	}))
+func TemplateFallback(fn func(r *http.Request) any) Option {
+	return func(h *handler) {
+		h.templateData = fn
+	}
+}
+
+// TemplateGlob additionally treats any file whose base name matches pattern
+// as a Go html/template, rendered the same way as the fallback file. pattern
+// is matched against the file's base name using path.Match (e.g. "*.html").
+//
+// Unlike the fallback file, files matched by TemplateGlob aren't known until
+// a request for them arrives, so they're parsed lazily on first use and
+// cached from then on; a parse error is returned as a 500 for that request
+// rather than panicking at startup.
+//
+// TemplateFallback must also be set, since it supplies the data function
+// used to render every matched template.
+func TemplateGlob(pattern string) Option {
+	return func(h *handler) {
+		h.templateGlob = pattern
+	}
+}
+
+// NoTemplateCache disables HTTP caching (no ETag is set) for responses
+// rendered through TemplateFallback/TemplateGlob, forcing clients to
+// re-fetch on every request.
+func NoTemplateCache() Option {
+	return func(h *handler) {
+		h.noTemplateCache = true
+	}
+}
+
+// TemplateCSPNonce generates a random nonce for each templated response,
+// exposes it to the template as {{.Nonce}}, and calls fn right before the
+// response is written so the Content-Security-Policy header can be kept in
+// sync with the nonce embedded in the HTML.
+//
+// Note that html/template escapes {{.Nonce}} according to the context it is
+// placed in: inside an HTML attribute (e.g. a <meta> tag's content), "+" is
+// rendered as "&#43;". Compare against the value passed to fn, not against
+// raw bytes of the rendered HTML, if you need to match the two.
+func TemplateCSPNonce(fn func(w http.ResponseWriter, r *http.Request, nonce string)) Option {
+	return func(h *handler) {
+		h.cspNonce = fn
+	}
+}
+
+// ErrorHandler installs a hook invoked whenever StaticHandler encounters an
+// error, along with the ErrorStage at which it occurred. fn may write a
+// custom response and return true to skip the handler's default behavior
+// (serving the fallback, or a bare 500), or return false to let it proceed
+// as usual.
+//
+// This also lets callers distinguish "not found" conditions that trigger the
+// SPA fallback from genuine I/O failures, which by default both resulted in
+// an opaque 500 with no way to log or alert on the difference. fn is also
+// called for StageServe errors, which happen once the response has already
+// started streaming and so can only be observed, not recovered from; its
+// return value is ignored in that case.
+func ErrorHandler(fn func(w http.ResponseWriter, r *http.Request, err error, stage ErrorStage) bool) Option {
+	return func(h *handler) {
+		h.errorHandler = fn
+	}
+}
+
+// BasePath declares that StaticHandler is mounted under the given URL
+// prefix, e.g. "/app". The prefix is stripped from incoming request paths
+// before the filesystem lookup, and the index-redirect target is rewritten
+// to include it (so a request for "/app/index.html" redirects to "/app/"
+// instead of "./"). Requests outside the prefix use the fallback logic, same
+// as any other not-found path.
+//
+// This replaces the need to wrap the handler with http.StripPrefix, which on
+// its own doesn't fix the redirect Location.
+//
+// When combined with TemplateFallback/TemplateGlob, the prefix is also
+// exposed to templates as {{.BasePath}}.
+func BasePath(p string) Option {
+	return func(h *handler) {
+		h.basePath = normalizeBasePath(p)
+	}
+}
+
+// Exclude marks request paths matching any of the given patterns as
+// excluded from the SPA fallback: instead of serving the fallback with a 200
+// status, the handler returns a real 404 (or delegates to a handler set with
+// ExcludeHandler). This avoids the common footgun of a typo'd or unmounted
+// API URL silently returning "index.html" with a 200, which breaks client
+// error handling and confuses monitoring.
+//
+// A pattern is matched against the request path after BasePath stripping. It
+// is treated as a regular expression if it starts with "^", otherwise as a
+// glob where "*" matches any sequence of characters (including "/") and "?"
+// matches exactly one character. Patterns are compiled once, when this
+// option is applied, and an invalid pattern panics.
+//
+//	StaticHandler(fs, Exclude("/api/*", "/metrics"))
+func Exclude(patterns ...string) Option {
+	return func(h *handler) {
+		for _, p := range patterns {
+			h.excludes = append(h.excludes, compileExcludePattern(p))
+		}
+	}
+}
+
+// ExcludeHandler sets the http.Handler that serves requests matched by
+// Exclude, instead of the default bare 404.
+func ExcludeHandler(eh http.Handler) Option {
+	return func(h *handler) {
+		h.excludeHandler = eh
+	}
+}
+
+func compileExcludePattern(pattern string) *regexp.Regexp {
+	if strings.HasPrefix(pattern, "^") {
+		return regexp.MustCompile(pattern)
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	b.WriteString("$")
+
+	return regexp.MustCompile(b.String())
+}
+
+func normalizeBasePath(p string) string {
+	if p == "" || p == "/" {
+		return ""
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return strings.TrimSuffix(p, "/")
+}
+
+// CacheControl installs rules that set Cache-Control (and optionally
+// Expires) headers on responses whose path matches. Rules are evaluated in
+// order and the first match wins; rules added by DefaultCaching, if any, are
+// only consulted after all of these.
+//
+//	StaticHandler(fs, CacheControl(
+//		CacheRule{Pattern: "*.woff2", CacheControl: "public, max-age=604800"},
+//	))
+func CacheControl(rules ...CacheRule) Option {
+	return func(h *handler) {
+		for _, rule := range rules {
+			h.cacheRules = append(h.cacheRules, compiledCacheRule{
+				pattern: compileExcludePattern(rule.Pattern),
+				rule:    rule,
+			})
+		}
+	}
+}
+
+// DefaultCaching installs sensible default caching behavior for SPA
+// deployments: the fallback file gets "no-cache, must-revalidate" so a new
+// deploy is picked up on the next navigation, while files carrying a content
+// hash in their name (e.g. "app.3f2a9c1d.js") get
+// "public, max-age=31536000, immutable" since they never change once built.
+//
+// Combined with the strong ETag/Last-Modified handling http.ServeContent
+// already provides, this gives SPAs the caching behavior they usually want
+// without having to wrap the handler to duplicate this logic.
+func DefaultCaching() Option {
+	return func(h *handler) {
+		h.defaultCaching = true
+	}
+}
+
+// cacheControlFor returns the CacheRule that applies to fpath, if any.
+func (h *handler) cacheControlFor(fpath string) (CacheRule, bool) {
+	for _, cr := range h.cacheRules {
+		if cr.pattern.MatchString(fpath) {
+			return cr.rule, true
+		}
+	}
+
+	if h.defaultCaching {
+		if fpath == h.fallback || strings.HasSuffix(fpath, "/index.html") {
+			return CacheRule{CacheControl: "no-cache, must-revalidate"}, true
+		}
+
+		if hashedAssetPattern.MatchString(fpath) {
+			return CacheRule{CacheControl: "public, max-age=31536000, immutable"}, true
+		}
+	}
+
+	return CacheRule{}, false
+}
+
+// applyCaching sets the Cache-Control/Expires headers for fpath, if a rule
+// matches it.
+func (h *handler) applyCaching(w http.ResponseWriter, fpath string) {
+	rule, ok := h.cacheControlFor(fpath)
+	if !ok {
+		return
+	}
+
+	if rule.CacheControl != "" {
+		w.Header().Set("Cache-Control", rule.CacheControl)
+	}
+
+	if rule.Expires > 0 {
+		w.Header().Set("Expires", time.Now().Add(rule.Expires).UTC().Format(http.TimeFormat))
+	}
+}
+
+// StaticHandlerFS is like StaticHandler, but accepts the modern io/fs.FS
+// interface instead of http.FileSystem. This lets embed.FS values and fs.Sub
+// results be used directly, without wrapping them in http.FS first.
+//
+//	//go:embed dist
+//	var distFS embed.FS
+//
+//	StaticHandlerFS(spa.Sub(distFS, "dist"))
+func StaticHandlerFS(fsys fs.FS, opts ...Option) http.Handler {
+	return StaticHandler(http.FS(fsys), opts...)
+}
+
+// Sub returns the subtree of fsys rooted at dir, for use with
+// StaticHandlerFS. It panics if dir doesn't exist, since dir is expected to
+// be a constant known at startup (e.g. the directory an embed.FS is rooted
+// at). This avoids the common mistake of passing an embed.FS rooted at the
+// module root and getting 404s for every request.
+func Sub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+
+	return sub
+}
+
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fpath := r.URL.Path
 	if !strings.HasPrefix(fpath, "/") {
 		fpath = "/" + fpath
 	}
 
+	if h.basePath != "" {
+		if fpath != h.basePath && !strings.HasPrefix(fpath, h.basePath+"/") {
+			h.handleError(w, r, fs.ErrNotExist, StageLookup)
+			return
+		}
+
+		fpath = strings.TrimPrefix(fpath, h.basePath)
+		if fpath == "" {
+			fpath = "/"
+		}
+	}
+
+	trailingSlash := fpath != "/" && strings.HasSuffix(fpath, "/")
+
+	// Clean before matching Exclude patterns (and before the index-redirect
+	// and lookup below), so a path like "/foo/../api/users" can't dodge an
+	// Exclude("/api/*") rule by hiding behind dot segments.
+	fpath = path.Clean(fpath)
+
+	if h.isExcluded(fpath) {
+		if h.excludeHandler != nil {
+			h.excludeHandler.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
 	if h.indexRedirect && strings.HasSuffix(fpath, "/index.html") {
-		redirect(w, r, "./")
+		dst := "./"
+		if h.basePath != "" {
+			// fpath has already had h.basePath stripped off, so reattach it
+			// to the containing directory instead of collapsing to the
+			// mount root, or a nested "/app/dir/index.html" would redirect
+			// to "/app/" and lose "/dir/".
+			dst = h.basePath + strings.TrimSuffix(fpath, "index.html")
+		}
+
+		redirect(w, r, dst)
 		return
 	}
 
-	if fpath != "/" && strings.HasSuffix(fpath, "/") {
-		h.handleError(w, r, fs.ErrNotExist)
+	if trailingSlash {
+		h.handleError(w, r, fs.ErrNotExist, StageLookup)
 		return
 	}
 
-	f, err := h.fs.Open(path.Clean(fpath))
+	f, err := h.fs.Open(fpath)
 	if err != nil {
-		h.handleError(w, r, err)
+		h.handleError(w, r, err, StageLookup)
 		return
 	}
 	defer f.Close()
 
 	fi, err := f.Stat()
 	if err != nil {
-		h.handleError(w, r, err)
+		h.handleError(w, r, err, StageStat)
 		return
 	}
 
 	if !fi.Mode().IsRegular() {
-		h.handleError(w, r, fs.ErrNotExist)
+		h.handleError(w, r, fs.ErrNotExist, StageStat)
 		return
 	}
 
-	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	if h.isTemplated(fpath) {
+		h.serveTemplate(w, r, fpath)
+		return
+	}
+
+	h.applyCaching(w, fpath)
+
+	if len(h.precompressed) > 0 {
+		if cf, cfi, encoding, ok := h.openPrecompressed(r, fpath); ok {
+			defer cf.Close()
+
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Add("Vary", "Accept-Encoding")
+			w.Header().Set("ETag", precompressedETag(cfi, encoding))
+
+			http.ServeContent(w, r, fi.Name(), cfi.ModTime(), h.wrapForServe(w, r, cf))
+			return
+		}
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), h.wrapForServe(w, r, f))
 }
 
-func (h *handler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+// openPrecompressed returns the best precompressed variant of fpath accepted
+// by the request, in preference order, or ok == false if none is usable.
+func (h *handler) openPrecompressed(r *http.Request, fpath string) (f http.File, fi fs.FileInfo, encoding string, ok bool) {
+	accepted := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+
+	type candidate struct {
+		encoding string
+		q        float64
+		rank     int
+	}
+
+	var candidates []candidate
+	for i, enc := range h.precompressed {
+		if _, known := precompressedExt[enc]; !known {
+			continue
+		}
+
+		q, ok := acceptedQuality(accepted, enc)
+		if !ok || q <= 0 {
+			continue
+		}
+
+		candidates = append(candidates, candidate{enc, q, i})
+	}
+
+	// q only gates whether an encoding is usable at all (filtered above); the
+	// server's configured preference order (rank) decides the winner among
+	// usable encodings, per PrecompressedEncodings' documented contract.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rank < candidates[j].rank
+	})
+
+	for _, c := range candidates {
+		cf, err := h.fs.Open(fpath + precompressedExt[c.encoding])
+		if err != nil {
+			continue
+		}
+
+		cfi, err := cf.Stat()
+		if err != nil || !cfi.Mode().IsRegular() {
+			cf.Close()
+			continue
+		}
+
+		return cf, cfi, c.encoding, true
+	}
+
+	return nil, nil, "", false
+}
+
+// parseAcceptEncoding parses the value of an Accept-Encoding header into a
+// map of content-coding to q-value.
+func parseAcceptEncoding(header string) map[string]float64 {
+	result := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		enc := part
+		q := 1.0
+
+		if idx := strings.IndexByte(part, ';'); idx >= 0 {
+			enc = strings.TrimSpace(part[:idx])
+
+			for _, param := range strings.Split(part[idx+1:], ";") {
+				name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+				if !found || strings.TrimSpace(name) != "q" {
+					continue
+				}
+
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		result[strings.ToLower(enc)] = q
+	}
+
+	return result
+}
+
+// acceptedQuality reports the q-value the client assigned to encoding, based
+// on an explicit entry or the "*" wildcard. ok is false when the encoding is
+// not accepted at all.
+func acceptedQuality(accepted map[string]float64, encoding string) (q float64, ok bool) {
+	if len(accepted) == 0 {
+		return 0, false
+	}
+
+	if q, found := accepted[encoding]; found {
+		return q, true
+	}
+
+	if q, found := accepted["*"]; found {
+		return q, true
+	}
+
+	return 0, false
+}
+
+// precompressedETag builds an ETag for a precompressed file that incorporates
+// the content-coding, so that clients and shared caches can't conflate
+// different encodings of the same resource.
+func precompressedETag(fi fs.FileInfo, encoding string) string {
+	return `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 36) +
+		"-" + strconv.FormatInt(fi.Size(), 36) +
+		"-" + encoding + `"`
+}
+
+func (h *handler) handleError(w http.ResponseWriter, r *http.Request, err error, stage ErrorStage) {
+	if h.reportError(w, r, err, stage) {
+		return
+	}
+
 	if h.fallback == "" || (!errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission)) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	if h.isTemplated(h.fallback) {
+		h.serveTemplate(w, r, h.fallback)
+		return
+	}
+
 	f, err := h.fs.Open(h.fallback)
 	if err != nil {
+		if h.reportError(w, r, err, StageOpenFallback) {
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -114,16 +694,216 @@ func (h *handler) handleError(w http.ResponseWriter, r *http.Request, err error)
 
 	fi, err := f.Stat()
 	if err != nil {
+		if h.reportError(w, r, err, StageOpenFallback) {
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	if !fi.Mode().IsRegular() {
+		if h.reportError(w, r, fs.ErrNotExist, StageOpenFallback) {
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h.applyCaching(w, h.fallback)
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), h.wrapForServe(w, r, f))
+}
+
+// reportError calls the configured ErrorHandler, if any, and returns whether
+// it fully handled the response.
+func (h *handler) reportError(w http.ResponseWriter, r *http.Request, err error, stage ErrorStage) bool {
+	if h.errorHandler == nil {
+		return false
+	}
+
+	return h.errorHandler(w, r, err, stage)
+}
+
+// wrapForServe wraps f so that a mid-stream read error is reported through
+// ErrorHandler at StageServe. It is a no-op when no ErrorHandler is set.
+func (h *handler) wrapForServe(w http.ResponseWriter, r *http.Request, f http.File) http.File {
+	if h.errorHandler == nil {
+		return f
+	}
+
+	return &reportingFile{File: f, h: h, w: w, r: r}
+}
+
+type reportingFile struct {
+	http.File
+
+	h *handler
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func (f *reportingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		f.h.reportError(f.w, f.r, err, StageServe)
+	}
+
+	return n, err
+}
+
+// isExcluded reports whether fpath matches one of the patterns set with
+// Exclude.
+func (h *handler) isExcluded(fpath string) bool {
+	for _, re := range h.excludes {
+		if re.MatchString(fpath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTemplated reports whether fpath should be rendered through
+// TemplateFallback/TemplateGlob instead of served as a static file.
+func (h *handler) isTemplated(fpath string) bool {
+	if h.templateData == nil {
+		return false
+	}
+
+	if fpath == h.fallback {
+		return true
+	}
+
+	if h.templateGlob != "" {
+		if ok, _ := path.Match(h.templateGlob, path.Base(fpath)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getTemplate returns the compiled template for fpath. The fallback file is
+// already compiled and cached by the time StaticHandler returns; anything
+// else (matched via TemplateGlob) is parsed and cached on first use.
+func (h *handler) getTemplate(fpath string) (*compiledTemplate, error) {
+	h.templatesMu.RLock()
+	ct, ok := h.templates[fpath]
+	h.templatesMu.RUnlock()
+
+	if ok {
+		return ct, nil
+	}
+
+	h.templatesMu.Lock()
+	defer h.templatesMu.Unlock()
+
+	if ct, ok := h.templates[fpath]; ok {
+		return ct, nil
+	}
+
+	ct, err := h.parseTemplate(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.templates == nil {
+		h.templates = make(map[string]*compiledTemplate)
+	}
+	h.templates[fpath] = ct
+
+	return ct, nil
+}
+
+// parseTemplate reads and parses fpath as a Go html/template, without
+// touching the cache.
+func (h *handler) parseTemplate(fpath string) (*compiledTemplate, error) {
+	f, err := h.fs.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	src, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(path.Base(fpath)).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	return &compiledTemplate{tmpl: tmpl, src: src}, nil
+}
+
+// serveTemplate renders the template at fpath and writes it to w.
+func (h *handler) serveTemplate(w http.ResponseWriter, r *http.Request, fpath string) {
+	ct, err := h.getTemplate(fpath)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var nonce string
+	if h.cspNonce != nil {
+		nonce, err = generateNonce()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ctx := templateContext{Nonce: nonce, BasePath: h.basePath}
+	if h.templateData != nil {
+		ctx.Data = h.templateData(r)
+	}
+
+	var buf bytes.Buffer
+	if err := ct.tmpl.Execute(&buf, ctx); err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	if h.cspNonce != nil {
+		h.cspNonce(w, r, nonce)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	h.applyCaching(w, fpath)
+
+	if h.noTemplateCache {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("ETag", templateETag(ct.src, ctx))
+	}
+
+	http.ServeContent(w, r, fpath, time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// generateNonce returns a random base64-encoded CSP nonce.
+func generateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// templateETag builds a stable ETag from the template source and the
+// rendered data, so unchanged content keeps the same ETag across requests.
+func templateETag(src []byte, ctx templateContext) string {
+	sum := sha256.New()
+	sum.Write(src)
+	sum.Write([]byte(ctx.Nonce))
+
+	if b, err := json.Marshal(ctx.Data); err == nil {
+		sum.Write(b)
+	}
+
+	return `"` + hex.EncodeToString(sum.Sum(nil))[:32] + `"`
 }
 
 func redirect(w http.ResponseWriter, r *http.Request, dst string) {
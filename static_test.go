@@ -1,15 +1,21 @@
 package spa_test
 
 import (
+	"errors"
+	"html"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
 	"testing"
 
 	"github.com/Desuuuu/go-spa"
 	"github.com/stretchr/testify/require"
 )
 
+var cspNonceMetaTag = regexp.MustCompile(`name="csp-nonce" content="([^"]*)"`)
+
 func Example() {
 	http.Handle("/", spa.StaticHandler(http.Dir("/static")))
 }
@@ -76,6 +82,341 @@ func TestStaticHandler(t *testing.T) {
 		require.Equal(t, http.StatusOK, res.StatusCode)
 		require.Equal(t, readFile(testFS, "/dir/test.js"), readAll(res.Body))
 	})
+
+	t.Run("precompressed variant negotiated", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.PrecompressedEncodings([]string{"br", "gzip"}))
+
+		r := httptest.NewRequest(http.MethodGet, "/test.css", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		res := w.Result()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+		require.Equal(t, "text/css; charset=utf-8", res.Header.Get("Content-Type"))
+		require.Equal(t, readFile(testFS, "/test.css.gz"), readAll(res.Body))
+	})
+
+	t.Run("server preference order wins over client q-values", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.PrecompressedEncodings([]string{"gzip", "br"}))
+
+		r := httptest.NewRequest(http.MethodGet, "/test.css", nil)
+		r.Header.Set("Accept-Encoding", "gzip;q=0.5, br;q=0.9")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		res := w.Result()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+		require.Equal(t, readFile(testFS, "/test.css.gz"), readAll(res.Body))
+	})
+
+	t.Run("precompressed variant not accepted falls back to original", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.PrecompressedEncodings([]string{"gzip"}))
+
+		res := makeRequest(h, http.MethodGet, "/test.css")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "", res.Header.Get("Content-Encoding"))
+		require.Equal(t, readFile(testFS, "/test.css"), readAll(res.Body))
+	})
+
+	t.Run("precompressed variant missing falls back to original", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.PrecompressedEncodings([]string{"gzip"}))
+
+		r := httptest.NewRequest(http.MethodGet, "/dir/test.js", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		res := w.Result()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "", res.Header.Get("Content-Encoding"))
+		require.Equal(t, readFile(testFS, "/dir/test.js"), readAll(res.Body))
+	})
+}
+
+func TestTemplateFallback(t *testing.T) {
+	testFS := http.Dir("./testdata")
+
+	t.Run("renders data and sets a stable ETag", func(t *testing.T) {
+		h := spa.StaticHandler(testFS,
+			spa.Fallback("/template.html"),
+			spa.TemplateFallback(func(r *http.Request) any {
+				return "/app/"
+			}),
+		)
+
+		res := makeRequest(h, http.MethodGet, "/missing")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, readAll(res.Body), `base href="/app/"`)
+		require.NotEmpty(t, res.Header.Get("ETag"))
+
+		res2 := makeRequest(h, http.MethodGet, "/missing")
+		require.Equal(t, res.Header.Get("ETag"), res2.Header.Get("ETag"))
+	})
+
+	t.Run("CSP nonce matches between header and body", func(t *testing.T) {
+		var gotNonce string
+
+		h := spa.StaticHandler(testFS,
+			spa.Fallback("/template.html"),
+			spa.TemplateFallback(func(r *http.Request) any { return "" }),
+			spa.TemplateCSPNonce(func(w http.ResponseWriter, r *http.Request, nonce string) {
+				gotNonce = nonce
+				w.Header().Set("Content-Security-Policy", "script-src 'nonce-"+nonce+"'")
+			}),
+		)
+
+		res := makeRequest(h, http.MethodGet, "/missing")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.NotEmpty(t, gotNonce)
+		require.Contains(t, res.Header.Get("Content-Security-Policy"), gotNonce)
+
+		// The nonce is rendered inside an HTML attribute, so html/template
+		// escapes characters like "+" (e.g. to "&#43;"). Unescape before
+		// comparing instead of matching raw bytes, or this fails whenever a
+		// generated nonce happens to contain one of those characters.
+		match := cspNonceMetaTag.FindStringSubmatch(readAll(res.Body))
+		require.Len(t, match, 2)
+		require.Equal(t, gotNonce, html.UnescapeString(match[1]))
+	})
+
+	t.Run("no template cache disables ETag", func(t *testing.T) {
+		h := spa.StaticHandler(testFS,
+			spa.Fallback("/template.html"),
+			spa.TemplateFallback(func(r *http.Request) any { return "" }),
+			spa.NoTemplateCache(),
+		)
+
+		res := makeRequest(h, http.MethodGet, "/missing")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Empty(t, res.Header.Get("ETag"))
+		require.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+	})
+}
+
+type brokenFS struct {
+	http.FileSystem
+	brokenPath string
+	err        error
+}
+
+func (fs brokenFS) Open(name string) (http.File, error) {
+	if name == fs.brokenPath {
+		return nil, fs.err
+	}
+
+	return fs.FileSystem.Open(name)
+}
+
+func TestErrorHandler(t *testing.T) {
+	testFS := http.Dir("./testdata")
+	ioErr := errors.New("disk on fire")
+
+	t.Run("not-found errors still fall back by default", func(t *testing.T) {
+		var stages []spa.ErrorStage
+
+		h := spa.StaticHandler(testFS, spa.ErrorHandler(func(w http.ResponseWriter, r *http.Request, err error, stage spa.ErrorStage) bool {
+			stages = append(stages, stage)
+			return false
+		}))
+
+		res := makeRequest(h, http.MethodGet, "/missing.js")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(testFS, "/index.html"), readAll(res.Body))
+		require.Equal(t, []spa.ErrorStage{spa.StageLookup}, stages)
+	})
+
+	t.Run("genuine I/O errors are reported distinctly from not-found", func(t *testing.T) {
+		fs := brokenFS{FileSystem: testFS, brokenPath: "/broken.js", err: ioErr}
+
+		var gotErr error
+		var gotStage spa.ErrorStage
+
+		h := spa.StaticHandler(fs, spa.ErrorHandler(func(w http.ResponseWriter, r *http.Request, err error, stage spa.ErrorStage) bool {
+			gotErr = err
+			gotStage = stage
+			return false
+		}))
+
+		res := makeRequest(h, http.MethodGet, "/broken.js")
+		require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+		require.Equal(t, ioErr, gotErr)
+		require.Equal(t, spa.StageLookup, gotStage)
+	})
+
+	t.Run("hook can fully handle the response", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.ErrorHandler(func(w http.ResponseWriter, r *http.Request, err error, stage spa.ErrorStage) bool {
+			w.WriteHeader(http.StatusTeapot)
+			return true
+		}))
+
+		res := makeRequest(h, http.MethodGet, "/missing.js")
+		require.Equal(t, http.StatusTeapot, res.StatusCode)
+	})
+}
+
+func TestBasePath(t *testing.T) {
+	testFS := http.Dir("./testdata")
+
+	t.Run("strips prefix before filesystem lookup", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.BasePath("/app"))
+
+		res := makeRequest(h, http.MethodGet, "/app/test.css")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(testFS, "/test.css"), readAll(res.Body))
+	})
+
+	t.Run("index redirect includes the prefix", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.BasePath("/app"))
+
+		res := makeRequest(h, http.MethodGet, "/app/index.html")
+		require.Equal(t, http.StatusMovedPermanently, res.StatusCode)
+		require.Equal(t, "/app/", res.Header.Get("Location"))
+	})
+
+	t.Run("index redirect from a nested directory keeps the directory", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.BasePath("/app"))
+
+		res := makeRequest(h, http.MethodGet, "/app/dir/index.html")
+		require.Equal(t, http.StatusMovedPermanently, res.StatusCode)
+		require.Equal(t, "/app/dir/", res.Header.Get("Location"))
+	})
+
+	t.Run("root of the mount serves the fallback", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.BasePath("/app"))
+
+		res := makeRequest(h, http.MethodGet, "/app/")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(testFS, "/index.html"), readAll(res.Body))
+	})
+
+	t.Run("requests outside the prefix use the fallback", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.BasePath("/app"))
+
+		res := makeRequest(h, http.MethodGet, "/other")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(testFS, "/index.html"), readAll(res.Body))
+	})
+
+	t.Run("exposes BasePath to templates", func(t *testing.T) {
+		h := spa.StaticHandler(testFS,
+			spa.BasePath("/app"),
+			spa.Fallback("/template.html"),
+			spa.TemplateFallback(func(r *http.Request) any { return "" }),
+		)
+
+		res := makeRequest(h, http.MethodGet, "/app/")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Contains(t, readAll(res.Body), `content="/app"`)
+	})
+}
+
+func TestExclude(t *testing.T) {
+	testFS := http.Dir("./testdata")
+
+	t.Run("excluded paths get a real 404 instead of the fallback", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.Exclude("/api/*", "/metrics"))
+
+		res := makeRequest(h, http.MethodGet, "/api/users/1")
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		res = makeRequest(h, http.MethodGet, "/metrics")
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("non-matching paths still use the fallback", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.Exclude("/api/*"))
+
+		res := makeRequest(h, http.MethodGet, "/app")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(testFS, "/index.html"), readAll(res.Body))
+	})
+
+	t.Run("regexp pattern", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.Exclude(`^/v[0-9]+/.*`))
+
+		res := makeRequest(h, http.MethodGet, "/v1/users")
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("dot segments can't be used to dodge a pattern", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.Exclude("/api/*"))
+
+		res := makeRequest(h, http.MethodGet, "/foo/../api/users")
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("custom exclude handler", func(t *testing.T) {
+		h := spa.StaticHandler(testFS,
+			spa.Exclude("/api/*"),
+			spa.ExcludeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			})),
+		)
+
+		res := makeRequest(h, http.MethodGet, "/api/users")
+		require.Equal(t, http.StatusBadGateway, res.StatusCode)
+	})
+}
+
+func TestStaticHandlerFS(t *testing.T) {
+	t.Run("serves from an io/fs.FS", func(t *testing.T) {
+		h := spa.StaticHandlerFS(os.DirFS("./testdata"))
+
+		res := makeRequest(h, http.MethodGet, "/test.css")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(http.Dir("./testdata"), "/test.css"), readAll(res.Body))
+	})
+
+	t.Run("Sub scopes into a subdirectory", func(t *testing.T) {
+		h := spa.StaticHandlerFS(spa.Sub(os.DirFS("./testdata"), "dir"))
+
+		res := makeRequest(h, http.MethodGet, "/test.js")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, readFile(http.Dir("./testdata/dir"), "/test.js"), readAll(res.Body))
+	})
+}
+
+func TestCacheControl(t *testing.T) {
+	testFS := http.Dir("./testdata")
+
+	t.Run("explicit rule matches by glob", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.CacheControl(
+			spa.CacheRule{Pattern: "*.css", CacheControl: "public, max-age=3600"},
+		))
+
+		res := makeRequest(h, http.MethodGet, "/test.css")
+		require.Equal(t, "public, max-age=3600", res.Header.Get("Cache-Control"))
+	})
+
+	t.Run("non-matching path gets no header", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.CacheControl(
+			spa.CacheRule{Pattern: "*.css", CacheControl: "public, max-age=3600"},
+		))
+
+		res := makeRequest(h, http.MethodGet, "/dir/test.js")
+		require.Equal(t, "", res.Header.Get("Cache-Control"))
+	})
+
+	t.Run("DefaultCaching sets no-cache on the fallback", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.DefaultCaching())
+
+		res := makeRequest(h, http.MethodGet, "/missing")
+		require.Equal(t, "no-cache, must-revalidate", res.Header.Get("Cache-Control"))
+	})
+
+	t.Run("DefaultCaching marks hashed assets immutable", func(t *testing.T) {
+		h := spa.StaticHandler(testFS, spa.DefaultCaching())
+
+		res := makeRequest(h, http.MethodGet, "/app.3f2a9c1d.js")
+		require.Equal(t, "public, max-age=31536000, immutable", res.Header.Get("Cache-Control"))
+
+		res = makeRequest(h, http.MethodGet, "/dir/test.js")
+		require.Equal(t, "", res.Header.Get("Cache-Control"))
+	})
 }
 
 func readFile(fs http.FileSystem, name string) string {